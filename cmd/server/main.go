@@ -10,6 +10,7 @@ import (
 
 	_ "github.com/lib/pq"
 	"gitlab.com/flotilla7/go/idempotency"
+	"gitlab.com/flotilla7/go/idempotency/pgstore"
 )
 
 var (
@@ -43,7 +44,9 @@ func main() {
 
 	mux := http.NewServeMux()
 	mux.Handle("/songs/list", app.listSongsHandler())
-	mux.Handle("/songs/create", idempotency.API(app.createSongHandler))
+	mux.Handle("/songs/create", idempotency.APIWithConfig(app.createSongHandler, idempotency.Config{
+		Store: pgstore.New(db, dsn, ""),
+	}))
 
 	addr := fmt.Sprintf(":%d", port)
 	fmt.Println("server listen on", addr)
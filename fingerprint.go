@@ -0,0 +1,46 @@
+package idempotency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"sort"
+)
+
+// fingerprint computes a stable hash identifying the request that reserved an
+// Idempotency-Key, per cfg. It returns nil when no fingerprinting is configured,
+// which disables reuse checking entirely.
+//
+// When cfg.FingerprintBody is set, r.Body is drained and restored via
+// io.NopCloser so the handler can still read it afterwards.
+func fingerprint(cfg Config, r *http.Request) ([]byte, error) {
+	if cfg.FingerprintFunc != nil {
+		return cfg.FingerprintFunc(r), nil
+	}
+	if !cfg.FingerprintBody && len(cfg.FingerprintHeaders) == 0 {
+		return nil, nil
+	}
+
+	h := sha256.New()
+	h.Write([]byte(r.Method))
+	h.Write([]byte(r.URL.Path))
+
+	headers := append([]string(nil), cfg.FingerprintHeaders...)
+	sort.Strings(headers)
+	for _, name := range headers {
+		h.Write([]byte(name))
+		h.Write([]byte(r.Header.Get(name)))
+	}
+
+	if cfg.FingerprintBody {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		h.Write(body)
+	}
+
+	return h.Sum(nil), nil
+}
@@ -1,18 +1,18 @@
 /* This package provides simple middleware for any http.Handler to maintain idempotency.
  * Call API to use default config.
- * Call APIWithConfig to configure for IK lifetime, cache cleanup interval, and minimum IK length.
+ * Call APIWithConfig to configure the Store, IK lifetime, cache cleanup interval, and minimum IK length.
  */
 package idempotency
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"time"
-
-	"github.com/patrickmn/go-cache"
 )
 
 const (
@@ -21,97 +21,267 @@ const (
 	DefMinIKLength     = 32
 )
 
+// Config configures an idempotencyAPI. Any zero-valued field falls back to the
+// same defaults as API.
+type Config struct {
+	// Store holds reservations and cached responses. Defaults to a MemoryStore,
+	// which is only safe for a single instance; use a Redis- or Postgres-backed
+	// Store for multi-replica deployments.
+	Store Store
+
+	// MinIKLen is the minimum accepted length for the Idempotency-Key header.
+	MinIKLen int
+
+	// Expiration is how long a reservation and its cached response live: it
+	// is the ttl passed to every Store.Add and Store.Replace call, whichever
+	// Store is used. Defaults to DefExpiration.
+	Expiration time.Duration
+
+	// CleanupInterval is how often the default MemoryStore sweeps expired
+	// entries. Only applies when Store is left unset. Defaults to
+	// DefCleanupInterval.
+	CleanupInterval time.Duration
+
+	// FingerprintBody, when true, includes the request body in the fingerprint
+	// used to detect an Idempotency-Key reused with a different request.
+	FingerprintBody bool
+
+	// FingerprintHeaders lists header names to include in the fingerprint.
+	FingerprintHeaders []string
+
+	// FingerprintFunc, if set, overrides FingerprintBody and FingerprintHeaders
+	// with a user-defined fingerprint of r.
+	FingerprintFunc func(r *http.Request) []byte
+
+	// WaitTimeout bounds how long a follower request waits for the reservation
+	// owner to finish. Defaults to DefWaitTimeout.
+	WaitTimeout time.Duration
+
+	// ScopeByRoute namespaces cache keys by method and path, so the same
+	// Idempotency-Key reused against two different routes doesn't collide.
+	// Defaults to true; set to a pointer to false to disable.
+	ScopeByRoute *bool
+
+	// Methods lists which HTTP methods flow through idempotency handling; any
+	// other method is passed straight to handler. Defaults to DefMethods.
+	Methods []string
+
+	// SuccessOnly, when true, does not cache responses with a 5xx status, so a
+	// client retrying a transient failure gets a fresh attempt instead of the
+	// cached failure.
+	SuccessOnly bool
+}
+
+// DefMethods is the default value of Config.Methods: idempotency only matters
+// for methods that aren't already safe to retry.
+var DefMethods = []string{http.MethodPost, http.MethodPatch, http.MethodDelete}
+
+func (cfg Config) scopeByRoute() bool {
+	if cfg.ScopeByRoute == nil {
+		return true
+	}
+	return *cfg.ScopeByRoute
+}
+
+func (cfg Config) methodEnabled(method string) bool {
+	for _, m := range cfg.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
 // API returns middleware for http.ServeMux, and ensure idempotency for handler.
 func API(handler http.HandlerFunc) http.Handler {
-	return APIWithConfig(handler, DefExpiration, DefCleanupInterval, DefMinIKLength)
+	return APIWithConfig(handler, Config{})
 }
 
-// APIWithConfig works just like API, with configuration: expiration, cleanupInterval, and minIKLen.
-func APIWithConfig(handler http.HandlerFunc, expiration, cleanupInterval time.Duration, minIKLen int) http.Handler {
+// APIWithConfig works just like API, with explicit Config.
+func APIWithConfig(handler http.HandlerFunc, cfg Config) http.Handler {
+	if cfg.Expiration == 0 {
+		cfg.Expiration = DefExpiration
+	}
+	if cfg.CleanupInterval == 0 {
+		cfg.CleanupInterval = DefCleanupInterval
+	}
+	if cfg.Store == nil {
+		cfg.Store = NewMemoryStore(cfg.Expiration, cfg.CleanupInterval)
+	}
+	if cfg.MinIKLen == 0 {
+		cfg.MinIKLen = DefMinIKLength
+	}
+	if cfg.WaitTimeout == 0 {
+		cfg.WaitTimeout = DefWaitTimeout
+	}
+	if cfg.Methods == nil {
+		cfg.Methods = DefMethods
+	}
+
 	return &idempotencyAPI{
-		ikCache:  cache.New(expiration, cleanupInterval),
-		handler:  handler,
-		minIKLen: minIKLen,
+		cfg:     cfg,
+		handler: handler,
+		waiters: newWaitRegistry(),
 	}
 }
 
 // idempotencyAPI holds info in order to achieve idempotency for handler.
 type idempotencyAPI struct {
-	ikCache  *cache.Cache // map ik to response.
-	handler  http.HandlerFunc
-	minIKLen int
+	cfg     Config
+	handler http.HandlerFunc
+	waiters *waitRegistry
 }
 
-// ServeHTTP handles request to target API, checking if ik exists in ikCache, if yes returns cached response.
-// If not, call handler, and saves response to cache under key: ik.
+// ServeHTTP handles request to target API, checking if ik exists in the store, if yes returns cached response.
+// If not, call handler, and saves response to the store under key: ik, prefixed
+// with "<method>:<path>:" when ScopeByRoute is in effect (the default).
 func (i *idempotencyAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !i.cfg.methodEnabled(r.Method) {
+		i.handler(w, r)
+		return
+	}
+
 	ik := r.Header.Get("Idempotency-Key")
 	if ik == "" {
 		i.responseError(w, r, "missing header: Idempotency-Key", http.StatusBadRequest)
 		return
 	}
-	if len(ik) < i.minIKLen {
-		i.responseError(w, r, fmt.Sprintf("Minimum idempotency key length: %d", i.minIKLen), http.StatusBadRequest)
+	if len(ik) < i.cfg.MinIKLen {
+		i.responseError(w, r, fmt.Sprintf("Minimum idempotency key length: %d", i.cfg.MinIKLen), http.StatusBadRequest)
 		return
 	}
 
-	err := i.ikCache.Add(ik, &response{}, cache.DefaultExpiration)
+	key := ik
+	if i.cfg.scopeByRoute() {
+		key = r.Method + ":" + r.URL.Path + ":" + ik
+	}
+
+	fp, err := fingerprint(i.cfg, r)
 	if err != nil {
-		// ik existed, response with cached value.
-		resp, err := i.getResponse(ik)
+		i.responseError(w, r, "", http.StatusInternalServerError)
+		return
+	}
+
+	i.serve(key, fp, w, r)
+}
+
+// serve runs the reservation dance for key: win it and call handler, or wait
+// for whoever already holds it and replay their response. It can recurse
+// once a follower wakes up to find the reservation it was waiting on gone
+// (the owner dropped a SuccessOnly 5xx) — at that point nobody holds key
+// anymore, so we re-enter as if this were the first request for it.
+func (i *idempotencyAPI) serve(key string, fp []byte, w http.ResponseWriter, r *http.Request) {
+	added, err := i.cfg.Store.Add(key, i.cfg.Expiration)
+	if err != nil {
+		i.responseError(w, r, "", http.StatusInternalServerError)
+		return
+	}
+	if added {
+		// Register the wait channel immediately, in the same breath as
+		// winning the reservation, so a follower can never observe a
+		// reserved key with no one to wait on.
+		_, release := i.waiters.register(key)
+		i.serveOwned(key, fp, release, w, r)
+		return
+	}
+
+	// key existed, response with cached value.
+	resp, err := i.getResponse(key)
+	if err != nil {
+		i.responseError(w, r, "", http.StatusInternalServerError)
+		return
+	}
+	if fp != nil && len(resp.Fingerprint) > 0 && !bytes.Equal(fp, resp.Fingerprint) {
+		i.responseReuseMismatch(w)
+		return
+	}
+	if !resp.Ready {
+		if err := i.waiters.wait(r.Context(), i.cfg.Store, key, i.cfg.WaitTimeout); err != nil {
+			if errors.Is(err, context.Canceled) {
+				i.responseError(w, r, "", statusClientClosedRequest)
+			} else {
+				i.responseError(w, r, "", http.StatusGatewayTimeout)
+			}
+			return
+		}
+
+		resp, err = i.getResponse(key)
 		if err != nil {
-			i.responseError(w, r, "", http.StatusInternalServerError)
+			// The owner we were waiting on deleted its reservation (a
+			// SuccessOnly 5xx) instead of replacing it. Nobody holds key
+			// anymore: retry the reservation for a fresh attempt, rather
+			// than surfacing a stale 500 for a failure this request never saw.
+			i.serve(key, fp, w, r)
 			return
 		}
-		for !resp.Ready {
-			time.Sleep(45 * time.Millisecond)
+		// The placeholder we saw before waiting may have had no fingerprint
+		// recorded yet (serveOwned writes it before running handler), so a
+		// mismatch could have slipped past the check above. Now that resp is
+		// ready, its fingerprint is final: check again before replaying it.
+		if fp != nil && len(resp.Fingerprint) > 0 && !bytes.Equal(fp, resp.Fingerprint) {
+			i.responseReuseMismatch(w)
+			return
+		}
+	}
 
-			resp, err = i.getResponse(ik)
-			if err != nil {
-				i.responseError(w, r, "", http.StatusInternalServerError)
-				return
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.Status)
+	if resp.Body != nil {
+		w.Write(resp.Body)
+	}
+}
+
+// serveOwned runs handler for the request that won the reservation for key,
+// then publishes the result to any followers. release, from the waiters.
+// register call serve made right after winning the reservation, must fire on
+// every path, including a panic in i.handler, or followers (same process or,
+// if the Store is a Notifier, other replicas) would wait the full timeout.
+func (i *idempotencyAPI) serveOwned(key string, fp []byte, release func(), w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		release()
+		if notifier, ok := i.cfg.Store.(Notifier); ok {
+			if err := notifier.Notify(key); err != nil {
+				log.Printf("idempotency: notify failed for key %s: %v", key, err)
 			}
 		}
+	}()
 
-		for k, v := range resp.Header {
-			w.Header()[k] = v
-		}
-		w.WriteHeader(resp.Status)
-		if resp.Body != nil {
-			w.Write(resp.Body)
-		}
-		return
+	if fp != nil {
+		i.cfg.Store.Replace(key, &Response{Fingerprint: fp}, i.cfg.Expiration)
 	}
 
 	respWriter := &respCatcher{w, &bytes.Buffer{}, http.StatusOK}
 	i.handler(respWriter, r)
 
-	i.ikCache.Replace(ik,
-		&response{Ready: true, Header: respWriter.Header(), Status: respWriter.statusCode, Body: respWriter.body.Bytes()},
-		cache.DefaultExpiration,
+	if i.cfg.SuccessOnly && respWriter.statusCode >= 500 {
+		// Don't cache a transient failure: delete the reservation so a retry
+		// with the same key gets a fresh attempt instead of the cached error.
+		if err := i.cfg.Store.Delete(key); err != nil {
+			log.Printf("idempotency: delete failed for key %s: %v", key, err)
+		}
+		return
+	}
+
+	i.cfg.Store.Replace(key,
+		&Response{Ready: true, Header: respWriter.Header(), Status: respWriter.statusCode, Body: respWriter.body.Bytes(), Fingerprint: fp},
+		i.cfg.Expiration,
 	)
 }
 
-// API response, including status code, header, and body.
-type response struct {
-	Ready  bool // if response ready to be used
-	Header http.Header
-	Status int
-	Body   []byte
+// responseReuseMismatch responds 422 Unprocessable Entity, indicating ik was
+// reused for a request that doesn't match the one that originally reserved it.
+func (i *idempotencyAPI) responseReuseMismatch(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error": "Idempotency-Key was reused with a different request",
+	})
 }
 
-func (i *idempotencyAPI) getResponse(ik string) (resp *response, err error) {
-	v, ok := i.ikCache.Get(ik)
-	if !ok {
-		err = fmt.Errorf("no valid response for ik: %s", ik)
-		return
-	}
-	resp, ok = v.(*response)
-	if !ok {
-		err = fmt.Errorf("no valid response for ik: %s", ik)
-		return
-	}
-	return
+func (i *idempotencyAPI) getResponse(ik string) (*Response, error) {
+	return i.cfg.Store.Get(ik)
 }
 
 // Extension to http.ResponseWriter for caching status code and response body.
@@ -140,6 +310,6 @@ func (i *idempotencyAPI) responseError(w http.ResponseWriter, r *http.Request, m
 }
 
 func (i *idempotencyAPI) dump(prefix string) {
-	bb, _ := json.MarshalIndent(i.ikCache.Items(), "", "  ")
-	log.Printf("ikCache %s:\n%s\n", prefix, bb)
+	bb, _ := json.MarshalIndent(i.cfg, "", "  ")
+	log.Printf("cfg %s:\n%s\n", prefix, bb)
 }
@@ -0,0 +1,235 @@
+package idempotency
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testIK = strings.Repeat("a", DefMinIKLength)
+
+// TestDuplicateInFlightWaitsForOwner guards against the wait-registry
+// registration-ordering bug: a follower that arrives while the owner is still
+// in flight must be woken by the owner finishing, not block for the full
+// WaitTimeout.
+func TestDuplicateInFlightWaitsForOwner(t *testing.T) {
+	var mu sync.Mutex
+	var calls int
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("ok"))
+	}
+
+	api := APIWithConfig(handler, Config{WaitTimeout: 2 * time.Second})
+
+	results := make(chan *httptest.ResponseRecorder, 2)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for n := 0; n < 2; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/songs/create", nil)
+			req.Header.Set("Idempotency-Key", testIK)
+			rec := httptest.NewRecorder()
+			api.ServeHTTP(rec, req)
+			results <- rec
+		}()
+		time.Sleep(10 * time.Millisecond) // let the first goroutine win the reservation
+	}
+	wg.Wait()
+	close(results)
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("duplicate request took %s; follower should be woken by the owner, not time out", elapsed)
+	}
+
+	mu.Lock()
+	if calls != 1 {
+		t.Fatalf("handler called %d times, want 1", calls)
+	}
+	mu.Unlock()
+
+	for rec := range results {
+		if rec.Code != http.StatusCreated {
+			t.Errorf("status = %d, want %d", rec.Code, http.StatusCreated)
+		}
+		if rec.Body.String() != "ok" {
+			t.Errorf("body = %q, want %q", rec.Body.String(), "ok")
+		}
+	}
+}
+
+func TestFingerprintMismatchRejected(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}
+
+	api := APIWithConfig(handler, Config{FingerprintBody: true})
+
+	req1 := httptest.NewRequest(http.MethodPost, "/songs/create", bytes.NewBufferString(`{"title":"a"}`))
+	req1.Header.Set("Idempotency-Key", testIK)
+	rec1 := httptest.NewRecorder()
+	api.ServeHTTP(rec1, req1)
+	if rec1.Code != http.StatusCreated {
+		t.Fatalf("first request status = %d, want %d", rec1.Code, http.StatusCreated)
+	}
+
+	req2 := httptest.NewRequest(http.MethodPost, "/songs/create", bytes.NewBufferString(`{"title":"b"}`))
+	req2.Header.Set("Idempotency-Key", testIK)
+	rec2 := httptest.NewRecorder()
+	api.ServeHTTP(rec2, req2)
+	if rec2.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("mismatched request status = %d, want %d", rec2.Code, http.StatusUnprocessableEntity)
+	}
+
+	// Same body as the first request should still hit the cache, not 422.
+	req3 := httptest.NewRequest(http.MethodPost, "/songs/create", bytes.NewBufferString(`{"title":"a"}`))
+	req3.Header.Set("Idempotency-Key", testIK)
+	rec3 := httptest.NewRecorder()
+	api.ServeHTTP(rec3, req3)
+	if rec3.Code != http.StatusCreated {
+		t.Fatalf("matching replay status = %d, want %d", rec3.Code, http.StatusCreated)
+	}
+}
+
+// raceStore wraps a Store and blocks on the owner's first Replace call (the
+// fingerprint placeholder serveOwned writes before running handler) until
+// released, so a test can deterministically land a follower's read in the
+// window where it observes a reservation with no fingerprint recorded yet.
+type raceStore struct {
+	Store
+	placeholderReplaced chan struct{}
+	released            chan struct{}
+	once                sync.Once
+}
+
+func (s *raceStore) Replace(key string, resp *Response, ttl time.Duration) error {
+	s.once.Do(func() {
+		close(s.placeholderReplaced)
+		<-s.released
+	})
+	return s.Store.Replace(key, resp, ttl)
+}
+
+// TestFingerprintRecheckedAfterWait guards against a follower that loses the
+// reservation race in the window between the owner's Store.Add and its
+// fingerprint placeholder Replace: such a follower sees a placeholder with no
+// fingerprint yet, so it can't reject the reuse before waiting. It must
+// re-check the fingerprint once resp is ready, rather than replaying the
+// owner's response to a request with a different body.
+func TestFingerprintRecheckedAfterWait(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}
+
+	rs := &raceStore{
+		Store:               NewMemoryStore(DefExpiration, DefCleanupInterval),
+		placeholderReplaced: make(chan struct{}),
+		released:            make(chan struct{}),
+	}
+	api := APIWithConfig(handler, Config{FingerprintBody: true, Store: rs, WaitTimeout: 2 * time.Second})
+
+	ownerDone := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		req := httptest.NewRequest(http.MethodPost, "/songs/create", bytes.NewBufferString(`{"title":"a"}`))
+		req.Header.Set("Idempotency-Key", testIK)
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, req)
+		ownerDone <- rec
+	}()
+
+	<-rs.placeholderReplaced // owner has won the reservation but hasn't recorded its fingerprint yet
+
+	followerDone := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		req := httptest.NewRequest(http.MethodPost, "/songs/create", bytes.NewBufferString(`{"title":"b"}`))
+		req.Header.Set("Idempotency-Key", testIK)
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, req)
+		followerDone <- rec
+	}()
+
+	time.Sleep(20 * time.Millisecond) // let the follower observe the fingerprint-less placeholder and start waiting
+	close(rs.released)
+
+	ownerRec := <-ownerDone
+	followerRec := <-followerDone
+
+	if ownerRec.Code != http.StatusCreated {
+		t.Fatalf("owner status = %d, want %d", ownerRec.Code, http.StatusCreated)
+	}
+	if followerRec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("follower status = %d, want %d (fingerprint must be re-checked after waking from wait)", followerRec.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+// TestSuccessOnlyFollowerRetriesAfterOwnerDrops5xx guards against a follower
+// surfacing a stale 500 after the owner it was waiting on deletes its
+// reservation (SuccessOnly dropping a 5xx): the follower should retry for a
+// fresh attempt instead.
+func TestSuccessOnlyFollowerRetriesAfterOwnerDrops5xx(t *testing.T) {
+	var mu sync.Mutex
+	var calls int
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		n := calls
+		mu.Unlock()
+
+		if n == 1 {
+			time.Sleep(50 * time.Millisecond) // give the follower time to start waiting
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("ok"))
+	}
+
+	api := APIWithConfig(handler, Config{SuccessOnly: true, WaitTimeout: 2 * time.Second})
+
+	results := make(chan *httptest.ResponseRecorder, 2)
+	var wg sync.WaitGroup
+	for n := 0; n < 2; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/songs/create", nil)
+			req.Header.Set("Idempotency-Key", testIK)
+			rec := httptest.NewRecorder()
+			api.ServeHTTP(rec, req)
+			results <- rec
+		}()
+		time.Sleep(10 * time.Millisecond) // let the first goroutine win the reservation
+	}
+	wg.Wait()
+	close(results)
+
+	var saw500, saw201 bool
+	for rec := range results {
+		switch rec.Code {
+		case http.StatusInternalServerError:
+			saw500 = true
+		case http.StatusCreated:
+			saw201 = true
+		default:
+			t.Errorf("unexpected status %d", rec.Code)
+		}
+	}
+	if !saw500 || !saw201 {
+		t.Fatalf("want one %d (the owner's failure) and one %d (the follower's fresh retry)", http.StatusInternalServerError, http.StatusCreated)
+	}
+}
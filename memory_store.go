@@ -0,0 +1,49 @@
+package idempotency
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// MemoryStore is a process-local Store, preserving the middleware's original
+// behavior. It is only safe for a single instance: two replicas behind a load
+// balancer each get their own cache and will not see each other's reservations.
+type MemoryStore struct {
+	cache *cache.Cache
+}
+
+// NewMemoryStore returns a MemoryStore whose entries expire after expiration,
+// sweeping expired entries every cleanupInterval.
+func NewMemoryStore(expiration, cleanupInterval time.Duration) *MemoryStore {
+	return &MemoryStore{cache: cache.New(expiration, cleanupInterval)}
+}
+
+func (s *MemoryStore) Add(key string, ttl time.Duration) (bool, error) {
+	if err := s.cache.Add(key, &Response{}, ttl); err != nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+func (s *MemoryStore) Get(key string) (*Response, error) {
+	v, ok := s.cache.Get(key)
+	if !ok {
+		return nil, fmt.Errorf("no valid response for ik: %s: %w", key, ErrNotFound)
+	}
+	resp, ok := v.(*Response)
+	if !ok {
+		return nil, fmt.Errorf("no valid response for ik: %s: %w", key, ErrNotFound)
+	}
+	return resp, nil
+}
+
+func (s *MemoryStore) Replace(key string, resp *Response, ttl time.Duration) error {
+	return s.cache.Replace(key, resp, ttl)
+}
+
+func (s *MemoryStore) Delete(key string) error {
+	s.cache.Delete(key)
+	return nil
+}
@@ -0,0 +1,219 @@
+// Package pgstore provides a Postgres-backed idempotency.Store, suitable for
+// services that already keep a Postgres connection around (see the sample
+// createSongHandler deployment in cmd/server).
+package pgstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"gitlab.com/flotilla7/go/idempotency"
+)
+
+// DefTable is the table name used when New is called with an empty table.
+const DefTable = "idempotency_keys"
+
+// notifyChannel is the Postgres NOTIFY channel shared by all keys. LISTEN is
+// per-channel rather than per-key, so Wait filters notifications by payload.
+const notifyChannel = "idempotency_keys"
+
+// Store is an idempotency.Store backed by Postgres. Reservation uses
+// INSERT ... ON CONFLICT DO NOTHING on a keyed table, so only one client wins
+// Add for a given key, e.g.:
+//
+//	CREATE TABLE idempotency_keys (
+//		key        TEXT PRIMARY KEY,
+//		response   JSONB,
+//		expires_at TIMESTAMPTZ NOT NULL
+//	);
+type Store struct {
+	db    *sql.DB
+	dsn   string
+	table string
+
+	// listener and waiters back Wait: a single LISTEN connection shared by
+	// every caller, instead of one dedicated connection per waiting follower.
+	listenOnce sync.Once
+	listenErr  error
+	listener   *pq.Listener
+	waitersMu  sync.Mutex
+	waiters    map[string][]chan struct{}
+}
+
+// New returns a Store using db. table defaults to DefTable when empty. dsn is
+// only needed to support Wait (LISTEN requires a dedicated connection outside
+// db's pool); pass "" if followers on other replicas don't need to be woken
+// via LISTEN/NOTIFY.
+func New(db *sql.DB, dsn, table string) *Store {
+	if table == "" {
+		table = DefTable
+	}
+	return &Store{db: db, dsn: dsn, table: table}
+}
+
+func (s *Store) Add(key string, ttl time.Duration) (bool, error) {
+	// An expired row is no longer a live reservation, but it would still make
+	// the INSERT below conflict: clear it first.
+	expired := fmt.Sprintf(`DELETE FROM %s WHERE key = $1 AND expires_at <= now()`, s.table)
+	if _, err := s.db.Exec(expired, key); err != nil {
+		return false, err
+	}
+
+	stmt := fmt.Sprintf(`INSERT INTO %s (key, expires_at) VALUES ($1, now() + $2::interval) ON CONFLICT (key) DO NOTHING`, s.table)
+	res, err := s.db.Exec(stmt, key, ttl.String())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (s *Store) Get(key string) (*idempotency.Response, error) {
+	stmt := fmt.Sprintf(`SELECT response FROM %s WHERE key = $1 AND expires_at > now()`, s.table)
+	var raw []byte
+	if err := s.db.QueryRow(stmt, key).Scan(&raw); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("no valid response for ik: %s: %w", key, idempotency.ErrNotFound)
+		}
+		return nil, err
+	}
+	if len(raw) == 0 {
+		// reservation placeholder: not ready yet.
+		return &idempotency.Response{}, nil
+	}
+
+	resp := &idempotency.Response{}
+	if err := json.Unmarshal(raw, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (s *Store) Replace(key string, resp *idempotency.Response, ttl time.Duration) error {
+	raw, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	stmt := fmt.Sprintf(`UPDATE %s SET response = $2, expires_at = now() + $3::interval WHERE key = $1`, s.table)
+	_, err = s.db.Exec(stmt, key, raw, ttl.String())
+	return err
+}
+
+func (s *Store) Delete(key string) error {
+	stmt := fmt.Sprintf(`DELETE FROM %s WHERE key = $1`, s.table)
+	_, err := s.db.Exec(stmt, key)
+	return err
+}
+
+// Notify implements idempotency.Notifier via pg_notify, so that followers on
+// other replicas blocked in Wait wake up immediately.
+func (s *Store) Notify(key string) error {
+	_, err := s.db.Exec(`SELECT pg_notify($1, $2)`, notifyChannel, key)
+	return err
+}
+
+// Wait implements idempotency.Waiter via LISTEN/NOTIFY, sharing one LISTEN
+// connection across every caller (a dedicated connection per waiting
+// follower is expensive under duplicate-request load).
+//
+// pg_notify may fire before we start waiting on key, so we register first,
+// then re-check Get, then block: any notification for key from this point on
+// is guaranteed to be seen by dispatch.
+func (s *Store) Wait(ctx context.Context, key string) error {
+	if err := s.ensureListening(); err != nil {
+		return err
+	}
+
+	ch := make(chan struct{})
+	s.addWaiter(key, ch)
+	defer s.removeWaiter(key, ch)
+
+	resp, err := s.Get(key)
+	if err == nil && resp.Ready {
+		return nil
+	}
+	if errors.Is(err, idempotency.ErrNotFound) {
+		// The owner deleted the reservation (e.g. a SuccessOnly 5xx) instead
+		// of replacing it, and dispatch only wakes us once. Return now so the
+		// caller can retry a fresh attempt, rather than blocking until
+		// WaitTimeout.
+		return nil
+	}
+
+	select {
+	case <-ch:
+		// dispatch woke us: either the response is ready or the reservation
+		// vanished. Either way, the caller re-Gets to find out which.
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Store) ensureListening() error {
+	s.listenOnce.Do(func() {
+		if s.dsn == "" {
+			s.listenErr = errors.New("pgstore: Wait requires a dsn; construct Store with New(db, dsn, table)")
+			return
+		}
+
+		s.waiters = make(map[string][]chan struct{})
+		s.listener = pq.NewListener(s.dsn, time.Second, 10*time.Second, nil)
+		if err := s.listener.Listen(notifyChannel); err != nil {
+			s.listenErr = err
+			return
+		}
+		go s.dispatch()
+	})
+	return s.listenErr
+}
+
+// dispatch fans pg notifications out to every Wait call currently blocked on
+// the notified key.
+func (s *Store) dispatch() {
+	for n := range s.listener.Notify {
+		if n == nil {
+			continue
+		}
+
+		s.waitersMu.Lock()
+		chs := s.waiters[n.Extra]
+		delete(s.waiters, n.Extra)
+		s.waitersMu.Unlock()
+
+		for _, ch := range chs {
+			close(ch)
+		}
+	}
+}
+
+func (s *Store) addWaiter(key string, ch chan struct{}) {
+	s.waitersMu.Lock()
+	s.waiters[key] = append(s.waiters[key], ch)
+	s.waitersMu.Unlock()
+}
+
+func (s *Store) removeWaiter(key string, ch chan struct{}) {
+	s.waitersMu.Lock()
+	defer s.waitersMu.Unlock()
+
+	chs := s.waiters[key]
+	for idx, c := range chs {
+		if c == ch {
+			s.waiters[key] = append(chs[:idx], chs[idx+1:]...)
+			break
+		}
+	}
+	if len(s.waiters[key]) == 0 {
+		delete(s.waiters, key)
+	}
+}
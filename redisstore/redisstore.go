@@ -0,0 +1,112 @@
+// Package redisstore provides a Redis-backed idempotency.Store, suitable for
+// multi-replica deployments where a process-local cache is not enough.
+package redisstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"gitlab.com/flotilla7/go/idempotency"
+)
+
+// Store is an idempotency.Store backed by Redis. Reservation uses SET NX EX so
+// that only one client across all replicas wins Add for a given key.
+type Store struct {
+	client *redis.Client
+}
+
+// New returns a Store using client.
+func New(client *redis.Client) *Store {
+	return &Store{client: client}
+}
+
+func (s *Store) Add(key string, ttl time.Duration) (bool, error) {
+	ok, err := s.client.SetNX(context.Background(), key, "", ttl).Result()
+	if err != nil {
+		return false, err
+	}
+	return ok, nil
+}
+
+func (s *Store) Get(key string) (*idempotency.Response, error) {
+	raw, err := s.client.Get(context.Background(), key).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, fmt.Errorf("no valid response for ik: %s: %w", key, idempotency.ErrNotFound)
+		}
+		return nil, err
+	}
+	if len(raw) == 0 {
+		// reservation placeholder: not ready yet.
+		return &idempotency.Response{}, nil
+	}
+
+	resp := &idempotency.Response{}
+	if err := json.Unmarshal(raw, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (s *Store) Replace(key string, resp *idempotency.Response, ttl time.Duration) error {
+	raw, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(context.Background(), key, raw, ttl).Err()
+}
+
+func (s *Store) Delete(key string) error {
+	return s.client.Del(context.Background(), key).Err()
+}
+
+// pubSubChannel is the Redis Pub/Sub channel used to wake up followers on
+// other replicas waiting on key, instead of polling.
+func pubSubChannel(key string) string {
+	return "ik:" + key
+}
+
+// Notify implements idempotency.Notifier by publishing to key's channel, so
+// that followers on other replicas blocked in Wait wake up immediately.
+func (s *Store) Notify(key string) error {
+	return s.client.Publish(context.Background(), pubSubChannel(key), "").Err()
+}
+
+// Wait implements idempotency.Waiter by subscribing to key's channel until
+// Get reports the response is ready, key's reservation vanishes, or ctx is
+// done.
+//
+// A PUBLISH with no subscriber is simply dropped, so Notify may have already
+// fired before we subscribe. To avoid that lost wakeup, we subscribe first,
+// then re-check Get, then loop: any Notify from this point on is guaranteed
+// to arrive on sub.Channel().
+func (s *Store) Wait(ctx context.Context, key string) error {
+	sub := s.client.Subscribe(ctx, pubSubChannel(key))
+	defer sub.Close()
+
+	for {
+		resp, err := s.Get(key)
+		if err == nil && resp.Ready {
+			return nil
+		}
+		if errors.Is(err, idempotency.ErrNotFound) {
+			// The owner deleted the reservation (e.g. a SuccessOnly 5xx)
+			// instead of replacing it, and it only notifies once: nobody is
+			// left to wake us again. Return now so the caller can retry a
+			// fresh attempt, rather than blocking until WaitTimeout.
+			return nil
+		}
+
+		select {
+		case <-sub.Channel():
+			// Loop back around and re-check Get rather than trusting this
+			// message alone: Get is the source of truth for readiness.
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package idempotency
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// ErrNotFound is returned by Store.Get (wrapped, so callers should compare
+// with errors.Is) when key has no reservation: it expired, was deleted, or
+// was never added. Wait implementations use this to tell a vanished
+// reservation apart from a Get that failed for some other reason.
+var ErrNotFound = errors.New("idempotency: no valid response for key")
+
+// Store is the persistence layer behind idempotency reservations. A Store must
+// make Add atomic across all callers that share it, so that exactly one caller
+// wins the reservation for a given key. This is what makes it safe to back the
+// middleware with something shared across replicas (Redis, Postgres, ...)
+// instead of an in-process cache.
+type Store interface {
+	// Add reserves key for ttl. It returns added=false (and no error) if key is
+	// already reserved by a previous, still-live call.
+	Add(key string, ttl time.Duration) (added bool, err error)
+
+	// Get returns the Response stored under key. It returns an error
+	// wrapping ErrNotFound if key has no reservation, e.g. because it
+	// expired or was never added.
+	Get(key string) (*Response, error)
+
+	// Replace stores resp under key, refreshing its ttl.
+	Replace(key string, resp *Response, ttl time.Duration) error
+
+	// Delete removes key's reservation, e.g. because its handler failed and
+	// SuccessOnly means the response shouldn't be cached.
+	Delete(key string) error
+}
+
+// Response is the cached result of a handler invocation, keyed by Idempotency-Key.
+type Response struct {
+	Ready       bool // if response ready to be used
+	Header      http.Header
+	Status      int
+	Body        []byte
+	Fingerprint []byte // hash of the request that reserved the key, if fingerprinting is enabled
+}
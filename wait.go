@@ -0,0 +1,101 @@
+package idempotency
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefWaitTimeout is how long a follower request waits for the reservation
+// owner to finish before giving up, when Config.WaitTimeout is unset.
+const DefWaitTimeout = 30 * time.Second
+
+// errWaitTimeout is returned by waitRegistry.wait when WaitTimeout elapses
+// before the reservation owner finishes. When wait falls back to a Store's
+// Waiter, a timeout surfaces instead as the Waiter's context error
+// (context.DeadlineExceeded).
+var errWaitTimeout = errors.New("idempotency: timed out waiting for response")
+
+// statusClientClosedRequest is nginx's de facto "client closed request" status,
+// used here when a follower's context is cancelled while waiting.
+const statusClientClosedRequest = 499
+
+// Notifier is implemented by a Store that can wake up followers waiting on
+// other replicas once a reservation's response is ready, e.g. via Redis
+// Pub/Sub or Postgres LISTEN/NOTIFY. It pairs with Waiter.
+type Notifier interface {
+	Notify(key string) error
+}
+
+// Waiter is implemented by a Store that can block a caller until another
+// replica finishes a reservation, instead of relying on the in-process
+// channel registry used for same-process followers.
+type Waiter interface {
+	Wait(ctx context.Context, key string) error
+}
+
+// waitRegistry tracks, per reservation key, a channel that the reservation
+// owner closes once its response is ready. It only coordinates followers
+// within this process; cross-replica followers fall back to the Store's
+// Waiter, if it implements one.
+type waitRegistry struct {
+	mu      sync.Mutex
+	waiters map[string]chan struct{}
+}
+
+func newWaitRegistry() *waitRegistry {
+	return &waitRegistry{waiters: make(map[string]chan struct{})}
+}
+
+// register returns a channel for key that release will close. The caller
+// (the reservation owner) must arrange for release to be called exactly
+// once, on every code path including panics.
+func (wr *waitRegistry) register(key string) (ch chan struct{}, release func()) {
+	ch = make(chan struct{})
+
+	wr.mu.Lock()
+	wr.waiters[key] = ch
+	wr.mu.Unlock()
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			wr.mu.Lock()
+			delete(wr.waiters, key)
+			wr.mu.Unlock()
+			close(ch)
+		})
+	}
+	return ch, release
+}
+
+// wait blocks until key's owner releases, ctx is cancelled, or timeout
+// elapses, whichever happens first. If no in-process waiter is registered for
+// key, it falls back to store's Waiter implementation, if any.
+func (wr *waitRegistry) wait(ctx context.Context, store Store, key string, timeout time.Duration) error {
+	wr.mu.Lock()
+	ch, ok := wr.waiters[key]
+	wr.mu.Unlock()
+
+	if !ok {
+		if waiter, ok := store.(Waiter); ok {
+			wctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			return waiter.Wait(wctx, key)
+		}
+		ch = nil // fall through to the timeout/cancel select below
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return errWaitTimeout
+	}
+}